@@ -0,0 +1,72 @@
+package processing
+
+// DCSO FEVER
+// Copyright (c) 2017, 2020, DCSO GmbH
+
+import (
+	"io"
+	"strings"
+
+	"github.com/DCSO/bloom"
+	log "github.com/sirupsen/logrus"
+)
+
+// bloomFilterBackend adapts github.com/DCSO/bloom.BloomFilter to the
+// IOCFilter interface used by BloomHandler.
+type bloomFilterBackend struct {
+	filter     *bloom.BloomFilter
+	filename   string
+	compressed bool
+}
+
+func newBloomFilterBackend(filter *bloom.BloomFilter, filename string, compressed bool) *bloomFilterBackend {
+	return &bloomFilterBackend{
+		filter:     filter,
+		filename:   filename,
+		compressed: compressed,
+	}
+}
+
+// Check returns true if item is (probably) present in the filter.
+func (b *bloomFilterBackend) Check(item []byte) bool {
+	return b.filter.Check(item)
+}
+
+// Add inserts item into the filter.
+func (b *bloomFilterBackend) Add(item []byte) {
+	b.filter.Add(item)
+}
+
+// Delete is a no-op: classic Bloom filters cannot remove elements once
+// added.
+func (b *bloomFilterBackend) Delete(item []byte) {
+	log.Warn("cannot delete individual indicators from a Bloom filter; ignoring")
+}
+
+// Len returns the number of items added to the filter.
+func (b *bloomFilterBackend) Len() uint64 {
+	return b.filter.N
+}
+
+// Reload reloads the Bloom filter from its backing file.
+func (b *bloomFilterBackend) Reload() error {
+	if b.filename == "" {
+		return &BloomNoFileErr{"filter was not created from a file, no reloading possible"}
+	}
+	iocBloom, err := bloom.LoadFilter(b.filename, b.compressed)
+	if err != nil {
+		if err == io.EOF {
+			log.Warnf("file is empty, using empty default one")
+			myBloom := bloom.Initialize(100, 0.00000001)
+			iocBloom = &myBloom
+		} else if strings.Contains(err.Error(), "value of k (number of hash functions) is too high") {
+			log.Warnf("malformed Bloom filter file, using empty default one")
+			myBloom := bloom.Initialize(100, 0.00000001)
+			iocBloom = &myBloom
+		} else {
+			return err
+		}
+	}
+	b.filter = iocBloom
+	return nil
+}
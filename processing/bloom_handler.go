@@ -4,11 +4,15 @@ package processing
 // Copyright (c) 2017, 2020, DCSO GmbH
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
 	"net/url"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/DCSO/fever/types"
 	"github.com/DCSO/fever/util"
@@ -106,7 +110,7 @@ type BloomHandler struct {
 	Logger                *log.Entry
 	Name                  string
 	EventType             string
-	IocBloom              *bloom.BloomFilter
+	IocFilter             IOCFilter
 	BloomFilename         string
 	BloomFileIsCompressed bool
 	DatabaseEventChan     chan types.Entry
@@ -114,6 +118,208 @@ type BloomHandler struct {
 	DoForwardAlert        bool
 	AlertPrefix           string
 	BlocklistIOCs         map[string]struct{}
+	StatsEncoder          util.StatsEncoder
+
+	SuppressionEnabled  bool
+	SuppressionWindow   time.Duration
+	SuppressionBurst    int
+	SuppressionCapacity int
+	suppressionState    map[string]*suppressionEntry
+	suppressedTotals    map[string]uint64
+	suppressionStopChan chan bool
+}
+
+// suppressionEntry is the token bucket and hit counter tracked for a
+// single (src_ip, ioc) tuple by the alert suppression logic.
+type suppressionEntry struct {
+	tokens     int
+	windowEnd  time.Time
+	lastSeen   time.Time
+	suppressed uint64
+}
+
+// attachSuppressedCount adds an `_extra.bloom-ioc-suppressed-count` field
+// to an alert, recording how many earlier matches for the same (src_ip,
+// ioc) tuple were suppressed before this alert was raised.
+func attachSuppressedCount(e types.Entry, count uint64) types.Entry {
+	if l, err := jsonparser.Set([]byte(e.JSONLine),
+		[]byte(strconv.FormatUint(count, 10)), "_extra", "bloom-ioc-suppressed-count"); err != nil {
+		log.Warning(err)
+	} else {
+		e.JSONLine = string(l)
+	}
+	return e
+}
+
+// bloomHit reports a match against the IOC Bloom filter to the configured
+// stats encoder, tracking the number of hits per triggering event type as
+// well as the current filter size.
+func (a *BloomHandler) bloomHit(eventType string) {
+	if a.StatsEncoder == nil {
+		return
+	}
+	a.StatsEncoder.IncrCounter("bloom_hits_total", map[string]string{"event_type": eventType}, 1)
+	a.StatsEncoder.SetGauge("bloom_filter_size", nil, float64(a.IocFilter.Len()))
+}
+
+// SubmitStats registers sc to receive this handler's bloom_hits_total
+// counter and bloom_filter_size gauge.
+func (a *BloomHandler) SubmitStats(sc util.StatsEncoder) {
+	a.Lock()
+	a.StatsEncoder = sc
+	a.Unlock()
+}
+
+// SetSuppression enables alert rate-limiting and deduplication: at most
+// burst alerts are raised per (src_ip, ioc) tuple within window, with any
+// further hits in that window folded into the suppressed-count of the
+// next alert raised for the same tuple instead of raising one of their
+// own. capacity bounds how many distinct tuples are tracked at once; the
+// least recently seen tuple is evicted once it is exceeded. A background
+// goroutine periodically emits a summary event via DatabaseEventChan
+// listing the most-suppressed IOCs since the last summary.
+func (a *BloomHandler) SetSuppression(window time.Duration, burst int, capacity int) {
+	a.Lock()
+	defer a.Unlock()
+	a.SuppressionEnabled = true
+	a.SuppressionWindow = window
+	a.SuppressionBurst = burst
+	a.SuppressionCapacity = capacity
+	a.suppressionState = make(map[string]*suppressionEntry)
+	a.suppressedTotals = make(map[string]uint64)
+	if a.suppressionStopChan == nil {
+		a.suppressionStopChan = make(chan bool)
+		go a.runSuppressionSummary(a.suppressionStopChan)
+	}
+}
+
+// StopSuppression stops the background summary goroutine started by
+// SetSuppression, if any.
+func (a *BloomHandler) StopSuppression() {
+	a.Lock()
+	stopChan := a.suppressionStopChan
+	a.suppressionStopChan = nil
+	a.Unlock()
+	if stopChan != nil {
+		close(stopChan)
+	}
+}
+
+// allowAlert applies the rate limiter/dedup logic for the (srcIP, ioc)
+// tuple. It reports whether a new alert should be raised right now, and
+// if so, how many prior hits for this tuple were folded into it.
+func (a *BloomHandler) allowAlert(srcIP, ioc string) (allow bool, suppressedCount uint64) {
+	if !a.SuppressionEnabled {
+		return true, 0
+	}
+	key := srcIP + "|" + ioc
+	now := time.Now()
+	se, ok := a.suppressionState[key]
+	if !ok || now.After(se.windowEnd) {
+		var carriedSuppressed uint64
+		if ok {
+			carriedSuppressed = se.suppressed
+		} else if len(a.suppressionState) >= a.SuppressionCapacity {
+			a.evictOldestSuppressionEntry()
+		}
+		se = &suppressionEntry{
+			tokens:     a.SuppressionBurst,
+			windowEnd:  now.Add(a.SuppressionWindow),
+			suppressed: carriedSuppressed,
+		}
+		a.suppressionState[key] = se
+	}
+	se.lastSeen = now
+	if se.tokens > 0 {
+		se.tokens--
+		suppressedCount = se.suppressed
+		se.suppressed = 0
+		return true, suppressedCount
+	}
+	se.suppressed++
+	a.suppressedTotals[ioc]++
+	return false, 0
+}
+
+// evictOldestSuppressionEntry drops the least recently seen tuple to keep
+// the suppression state bounded by SuppressionCapacity. Callers must hold
+// the handler lock.
+func (a *BloomHandler) evictOldestSuppressionEntry() {
+	var oldestKey string
+	var oldestTime time.Time
+	for k, se := range a.suppressionState {
+		if oldestKey == "" || se.lastSeen.Before(oldestTime) {
+			oldestKey = k
+			oldestTime = se.lastSeen
+		}
+	}
+	if oldestKey != "" {
+		delete(a.suppressionState, oldestKey)
+	}
+}
+
+// suppressedIOCCount is one row of the periodic suppression summary,
+// reporting how many alerts for a given IOC were folded away.
+type suppressedIOCCount struct {
+	IOC   string `json:"ioc"`
+	Count uint64 `json:"count"`
+}
+
+// runSuppressionSummary periodically emits a summary of suppressed IOCs
+// until stopChan is closed.
+func (a *BloomHandler) runSuppressionSummary(stopChan chan bool) {
+	a.Lock()
+	period := a.SuppressionWindow
+	a.Unlock()
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopChan:
+			return
+		case <-ticker.C:
+			a.emitSuppressionSummary()
+		}
+	}
+}
+
+// emitSuppressionSummary sends a 'stats' event listing the top ten IOCs by
+// number of suppressed alert hits since the last summary, then resets the
+// counters. Analysts relying on forwarded alerts alone would otherwise
+// lose visibility into how many hits a suppressed IOC actually caused.
+func (a *BloomHandler) emitSuppressionSummary() {
+	a.Lock()
+	if len(a.suppressedTotals) == 0 {
+		a.Unlock()
+		return
+	}
+	counts := make([]suppressedIOCCount, 0, len(a.suppressedTotals))
+	for ioc, n := range a.suppressedTotals {
+		counts = append(counts, suppressedIOCCount{IOC: ioc, Count: n})
+	}
+	a.suppressedTotals = make(map[string]uint64)
+	a.Unlock()
+
+	sort.Slice(counts, func(i, j int) bool { return counts[i].Count > counts[j].Count })
+	if len(counts) > 10 {
+		counts = counts[:10]
+	}
+
+	payload, err := json.Marshal(struct {
+		EventType string               `json:"event_type"`
+		Summary   []suppressedIOCCount `json:"bloom_suppression_summary"`
+	}{
+		EventType: "stats",
+		Summary:   counts,
+	})
+	if err != nil {
+		log.Warnf("could not encode bloom suppression summary: %s", err)
+		return
+	}
+	a.DatabaseEventChan <- types.Entry{
+		EventType: "stats",
+		JSONLine:  string(payload),
+	}
 }
 
 // BloomNoFileErr is an error thrown when a file-based operation (e.g.
@@ -129,15 +335,15 @@ func (e *BloomNoFileErr) Error() string {
 }
 
 // MakeBloomHandler returns a new BloomHandler, checking against the given
-// Bloom filter and sending alerts to databaseChan as well as forwarding them
-// to a given forwarding handler.
-func MakeBloomHandler(iocBloom *bloom.BloomFilter,
+// IOC filter (a Bloom or Cuckoo filter) and sending alerts to databaseChan
+// as well as forwarding them to a given forwarding handler.
+func MakeBloomHandler(iocFilter IOCFilter,
 	databaseChan chan types.Entry, forwardHandler Handler, alertPrefix string) *BloomHandler {
 	bh := &BloomHandler{
 		Logger: log.WithFields(log.Fields{
 			"domain": "bloom",
 		}),
-		IocBloom:          iocBloom,
+		IocFilter:         iocFilter,
 		DatabaseEventChan: databaseChan,
 		ForwardHandler:    forwardHandler,
 		DoForwardAlert:    (util.ForwardAllEvents || util.AllowType("alert")),
@@ -145,37 +351,29 @@ func MakeBloomHandler(iocBloom *bloom.BloomFilter,
 		BlocklistIOCs:     make(map[string]struct{}),
 	}
 	log.WithFields(log.Fields{
-		"N":      iocBloom.N,
+		"N":      iocFilter.Len(),
 		"domain": "bloom",
-	}).Info("Bloom filter loaded")
+	}).Info("IOC filter loaded")
 	return bh
 }
 
 // MakeBloomHandlerFromFile returns a new BloomHandler created from a new
-// Bloom filter specified by the given file name.
+// IOC filter read from the given file name. The filter backend (Bloom or
+// Cuckoo) is auto-detected from the file's header, so the on-disk
+// artifact can be swapped without changing how FEVER is invoked.
 func MakeBloomHandlerFromFile(bloomFilename string, compressed bool,
 	databaseChan chan types.Entry, forwardHandler Handler, alertPrefix string,
 	blockedIOCs []string) (*BloomHandler, error) {
 	log.WithFields(log.Fields{
 		"domain": "bloom",
-	}).Infof("loading Bloom filter '%s'", bloomFilename)
-	iocBloom, err := bloom.LoadFilter(bloomFilename, compressed)
+	}).Infof("loading IOC filter '%s'", bloomFilename)
+	iocFilter, err := loadIOCFilterFromFile(bloomFilename, compressed)
 	if err != nil {
-		if err == io.EOF {
-			log.Warnf("file is empty, using empty default one")
-			myBloom := bloom.Initialize(100, 0.00000001)
-			iocBloom = &myBloom
-		} else if strings.Contains(err.Error(), "value of k (number of hash functions) is too high") {
-			log.Warnf("malformed Bloom filter file, using empty default one")
-			myBloom := bloom.Initialize(100, 0.00000001)
-			iocBloom = &myBloom
-		} else {
-			return nil, err
-		}
+		return nil, err
 	}
-	bh := MakeBloomHandler(iocBloom, databaseChan, forwardHandler, alertPrefix)
+	bh := MakeBloomHandler(iocFilter, databaseChan, forwardHandler, alertPrefix)
 	for _, v := range blockedIOCs {
-		if bh.IocBloom.Check([]byte(v)) {
+		if bh.IocFilter.Check([]byte(v)) {
 			bh.Logger.Warnf("filter contains blocked indicator '%s'", v)
 		}
 		bh.BlocklistIOCs[v] = struct{}{}
@@ -186,12 +384,23 @@ func MakeBloomHandlerFromFile(bloomFilename string, compressed bool,
 	return bh, nil
 }
 
-// Reload triggers a reload of the contents of the file with the name.
-func (a *BloomHandler) Reload() error {
-	if a.BloomFilename == "" {
-		return &BloomNoFileErr{"BloomHandler was not created from a file, no reloading possible"}
+// loadIOCFilterFromFile loads an IOCFilter from filename, picking the
+// Cuckoo or Bloom backend depending on whether the file starts with the
+// Cuckoo filter magic header.
+func loadIOCFilterFromFile(filename string, compressed bool) (IOCFilter, error) {
+	isCuckoo, err := fileHasCuckooMagic(filename)
+	if err != nil {
+		if err == io.EOF {
+			log.Warnf("file is empty, using empty default Bloom filter")
+			myBloom := bloom.Initialize(100, 0.00000001)
+			return newBloomFilterBackend(&myBloom, filename, compressed), nil
+		}
+		return nil, err
+	}
+	if isCuckoo {
+		return LoadCuckooFilter(filename)
 	}
-	iocBloom, err := bloom.LoadFilter(a.BloomFilename, a.BloomFileIsCompressed)
+	iocBloom, err := bloom.LoadFilter(filename, compressed)
 	if err != nil {
 		if err == io.EOF {
 			log.Warnf("file is empty, using empty default one")
@@ -202,20 +411,35 @@ func (a *BloomHandler) Reload() error {
 			myBloom := bloom.Initialize(100, 0.00000001)
 			iocBloom = &myBloom
 		} else {
-			return err
+			return nil, err
 		}
 	}
+	return newBloomFilterBackend(iocBloom, filename, compressed), nil
+}
+
+// Reload triggers a reload of the filter's contents from its backing
+// file. The whole operation, including the backend's own file load, runs
+// under the handler lock: IOCFilter.Reload() is not guaranteed to
+// synchronize its own state swap (bloomFilterBackend in particular does
+// not), so Consume's concurrent IocFilter.Check() calls would otherwise
+// race against it.
+func (a *BloomHandler) Reload() error {
 	a.Lock()
-	a.IocBloom = iocBloom
+	defer a.Unlock()
+	if a.IocFilter == nil {
+		return &BloomNoFileErr{"BloomHandler was not created from a file, no reloading possible"}
+	}
+	if err := a.IocFilter.Reload(); err != nil {
+		return err
+	}
 	for k := range a.BlocklistIOCs {
-		if a.IocBloom.Check([]byte(k)) {
+		if a.IocFilter.Check([]byte(k)) {
 			a.Logger.Warnf("filter contains blocked indicator '%s'", k)
 		}
 	}
-	a.Unlock()
 	log.WithFields(log.Fields{
-		"N": iocBloom.N,
-	}).Info("Bloom filter reloaded")
+		"N": a.IocFilter.Len(),
+	}).Info("IOC filter reloaded")
 	return nil
 }
 
@@ -225,11 +449,17 @@ func (a *BloomHandler) Consume(e *types.Entry) error {
 		var fullURL string
 		a.Lock()
 		// check HTTP host first: foo.bar.de
-		if a.IocBloom.Check([]byte(e.HTTPHost)) {
+		if a.IocFilter.Check([]byte(e.HTTPHost)) {
 			if _, present := a.BlocklistIOCs[e.HTTPHost]; !present {
-				n := MakeAlertEntryForHit(*e, "http-host", a.AlertPrefix, e.HTTPHost)
-				a.DatabaseEventChan <- n
-				a.ForwardHandler.Consume(&n)
+				if allow, suppressed := a.allowAlert(e.SrcIP, e.HTTPHost); allow {
+					n := MakeAlertEntryForHit(*e, "http-host", a.AlertPrefix, e.HTTPHost)
+					if suppressed > 0 {
+						n = attachSuppressedCount(n, suppressed)
+					}
+					a.DatabaseEventChan <- n
+					a.ForwardHandler.Consume(&n)
+					a.bloomHit(e.EventType)
+				}
 			}
 		}
 		// we sometimes see full 'URLs' in the corresponding EVE field when
@@ -252,34 +482,52 @@ func (a *BloomHandler) Consume(e *types.Entry) error {
 
 		hostPath := fmt.Sprintf("%s%s", u.Host, u.Path)
 		// http://foo.bar.de:123/baz
-		if a.IocBloom.Check([]byte(fullURL)) {
+		if a.IocFilter.Check([]byte(fullURL)) {
 			if _, present := a.BlocklistIOCs[fullURL]; !present {
-				n := MakeAlertEntryForHit(*e, "http-url", a.AlertPrefix, fullURL)
-				a.DatabaseEventChan <- n
-				a.ForwardHandler.Consume(&n)
+				if allow, suppressed := a.allowAlert(e.SrcIP, fullURL); allow {
+					n := MakeAlertEntryForHit(*e, "http-url", a.AlertPrefix, fullURL)
+					if suppressed > 0 {
+						n = attachSuppressedCount(n, suppressed)
+					}
+					a.DatabaseEventChan <- n
+					a.ForwardHandler.Consume(&n)
+					a.bloomHit(e.EventType)
+				}
 			}
 		} else
 		// foo.bar.de:123/baz
-		if a.IocBloom.Check([]byte(hostPath)) {
+		if a.IocFilter.Check([]byte(hostPath)) {
 			if _, present := a.BlocklistIOCs[hostPath]; !present {
-				n := MakeAlertEntryForHit(*e, "http-url", a.AlertPrefix, hostPath)
-				a.DatabaseEventChan <- n
-				a.ForwardHandler.Consume(&n)
+				if allow, suppressed := a.allowAlert(e.SrcIP, hostPath); allow {
+					n := MakeAlertEntryForHit(*e, "http-url", a.AlertPrefix, hostPath)
+					if suppressed > 0 {
+						n = attachSuppressedCount(n, suppressed)
+					}
+					a.DatabaseEventChan <- n
+					a.ForwardHandler.Consume(&n)
+					a.bloomHit(e.EventType)
+				}
 			}
 		} else
 		// /baz
-		if a.IocBloom.Check([]byte(u.Path)) {
+		if a.IocFilter.Check([]byte(u.Path)) {
 			if _, present := a.BlocklistIOCs[u.Path]; !present {
-				n := MakeAlertEntryForHit(*e, "http-url", a.AlertPrefix, u.Path)
-				a.DatabaseEventChan <- n
-				a.ForwardHandler.Consume(&n)
+				if allow, suppressed := a.allowAlert(e.SrcIP, u.Path); allow {
+					n := MakeAlertEntryForHit(*e, "http-url", a.AlertPrefix, u.Path)
+					if suppressed > 0 {
+						n = attachSuppressedCount(n, suppressed)
+					}
+					a.DatabaseEventChan <- n
+					a.ForwardHandler.Consume(&n)
+					a.bloomHit(e.EventType)
+				}
 			}
 		}
 
 		a.Unlock()
 	} else if e.EventType == "dns" {
 		a.Lock()
-		if a.IocBloom.Check([]byte(e.DNSRRName)) {
+		if a.IocFilter.Check([]byte(e.DNSRRName)) {
 			if _, present := a.BlocklistIOCs[e.DNSRRName]; !present {
 				var n types.Entry
 				if e.DNSType == "query" {
@@ -291,18 +539,30 @@ func (a *BloomHandler) Consume(e *types.Entry) error {
 					a.Unlock()
 					return nil
 				}
-				a.DatabaseEventChan <- n
-				a.ForwardHandler.Consume(&n)
+				if allow, suppressed := a.allowAlert(e.SrcIP, e.DNSRRName); allow {
+					if suppressed > 0 {
+						n = attachSuppressedCount(n, suppressed)
+					}
+					a.DatabaseEventChan <- n
+					a.ForwardHandler.Consume(&n)
+					a.bloomHit(e.EventType)
+				}
 			}
 		}
 		a.Unlock()
 	} else if e.EventType == "tls" {
 		a.Lock()
-		if a.IocBloom.Check([]byte(e.TLSSni)) {
+		if a.IocFilter.Check([]byte(e.TLSSni)) {
 			if _, present := a.BlocklistIOCs[e.TLSSni]; !present {
-				n := MakeAlertEntryForHit(*e, "tls-sni", a.AlertPrefix, e.TLSSni)
-				a.DatabaseEventChan <- n
-				a.ForwardHandler.Consume(&n)
+				if allow, suppressed := a.allowAlert(e.SrcIP, e.TLSSni); allow {
+					n := MakeAlertEntryForHit(*e, "tls-sni", a.AlertPrefix, e.TLSSni)
+					if suppressed > 0 {
+						n = attachSuppressedCount(n, suppressed)
+					}
+					a.DatabaseEventChan <- n
+					a.ForwardHandler.Consume(&n)
+					a.bloomHit(e.EventType)
+				}
 			}
 		}
 		a.Unlock()
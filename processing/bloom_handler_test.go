@@ -0,0 +1,71 @@
+package processing
+
+// DCSO FEVER
+// Copyright (c) 2017, 2020, DCSO GmbH
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAllowAlertBurstAndWindow(t *testing.T) {
+	a := &BloomHandler{}
+	a.SetSuppression(50*time.Millisecond, 2, 10)
+	defer a.StopSuppression()
+
+	if allow, n := a.allowAlert("1.2.3.4", "evil.example"); !allow || n != 0 {
+		t.Fatalf("1st hit: allow=%v suppressed=%d, want true/0", allow, n)
+	}
+	if allow, n := a.allowAlert("1.2.3.4", "evil.example"); !allow || n != 0 {
+		t.Fatalf("2nd hit: allow=%v suppressed=%d, want true/0", allow, n)
+	}
+	if allow, _ := a.allowAlert("1.2.3.4", "evil.example"); allow {
+		t.Fatalf("3rd hit: allow=true, want false once burst is exhausted")
+	}
+	if allow, _ := a.allowAlert("1.2.3.4", "evil.example"); allow {
+		t.Fatalf("4th hit: allow=true, want false once burst is exhausted")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if allow, n := a.allowAlert("1.2.3.4", "evil.example"); !allow || n != 2 {
+		t.Fatalf("hit after window reset: allow=%v suppressed=%d, want true/2", allow, n)
+	}
+}
+
+func TestAllowAlertDistinctTuples(t *testing.T) {
+	a := &BloomHandler{}
+	a.SetSuppression(time.Minute, 1, 10)
+	defer a.StopSuppression()
+
+	if allow, _ := a.allowAlert("1.2.3.4", "evil.example"); !allow {
+		t.Fatalf("srcIP 1.2.3.4: allow=false, want true")
+	}
+	if allow, _ := a.allowAlert("5.6.7.8", "evil.example"); !allow {
+		t.Fatalf("distinct srcIP 5.6.7.8: allow=false, want true")
+	}
+	if allow, _ := a.allowAlert("1.2.3.4", "other.example"); !allow {
+		t.Fatalf("distinct IOC for same srcIP: allow=false, want true")
+	}
+}
+
+func TestAllowAlertEvictsLeastRecentlySeenAtCapacity(t *testing.T) {
+	a := &BloomHandler{}
+	a.SetSuppression(time.Minute, 1, 2)
+	defer a.StopSuppression()
+
+	a.allowAlert("1.1.1.1", "ioc-a")
+	a.allowAlert("2.2.2.2", "ioc-b")
+	// A third distinct tuple exceeds capacity, evicting ioc-a (least
+	// recently seen).
+	a.allowAlert("3.3.3.3", "ioc-c")
+
+	if len(a.suppressionState) != 2 {
+		t.Fatalf("suppressionState has %d entries, want 2", len(a.suppressionState))
+	}
+	if _, ok := a.suppressionState["1.1.1.1|ioc-a"]; ok {
+		t.Errorf("ioc-a should have been evicted, but is still tracked")
+	}
+	if _, ok := a.suppressionState["3.3.3.3|ioc-c"]; !ok {
+		t.Errorf("ioc-c should be tracked after insertion")
+	}
+}
@@ -0,0 +1,310 @@
+package processing
+
+// DCSO FEVER
+// Copyright (c) 2017, 2020, DCSO GmbH
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math/rand"
+	"os"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	cuckooBucketSize     = 4
+	cuckooMaxRelocations = 500
+)
+
+// cuckooFileMagic identifies files written by CuckooFilter.Save, letting
+// MakeBloomHandlerFromFile auto-detect a Cuckoo filter artifact and
+// distinguish it from a legacy Bloom filter file.
+var cuckooFileMagic = []byte("CKOO")
+
+type cuckooFingerprint uint16
+
+type cuckooBucket [cuckooBucketSize]cuckooFingerprint
+
+func (b *cuckooBucket) has(fp cuckooFingerprint) bool {
+	for _, slot := range b {
+		if slot == fp {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *cuckooBucket) insert(fp cuckooFingerprint) bool {
+	for i, slot := range b {
+		if slot == 0 {
+			b[i] = fp
+			return true
+		}
+	}
+	return false
+}
+
+func (b *cuckooBucket) remove(fp cuckooFingerprint) bool {
+	for i, slot := range b {
+		if slot == fp {
+			b[i] = 0
+			return true
+		}
+	}
+	return false
+}
+
+// CuckooFilter is a probabilistic set membership filter based on
+// partial-key cuckoo hashing: every item is stored as a 16-bit
+// fingerprint in one of two candidate buckets of 4 entries each. Unlike
+// the Bloom filter FEVER has traditionally used, a CuckooFilter supports
+// deleting individual indicators, at the cost of a small, bounded false
+// positive rate determined by the fingerprint size and bucket width.
+type CuckooFilter struct {
+	sync.Mutex
+	buckets   []cuckooBucket
+	count     uint64
+	evictions uint64
+	filename  string
+}
+
+// MakeCuckooFilter creates an empty CuckooFilter sized for at least
+// numBuckets buckets (rounded up to the next power of two, as required by
+// the partial-key index computation), each holding up to 4 entries.
+func MakeCuckooFilter(numBuckets uint64) *CuckooFilter {
+	return &CuckooFilter{
+		buckets: make([]cuckooBucket, nextPowerOfTwo(numBuckets)),
+	}
+}
+
+func nextPowerOfTwo(n uint64) uint64 {
+	p := uint64(1)
+	for p < n {
+		p <<= 1
+	}
+	return p
+}
+
+// fingerprintAndIndex derives a non-zero 16-bit fingerprint and the
+// primary bucket index for item.
+func fingerprintAndIndex(item []byte, numBuckets uint64) (cuckooFingerprint, uint64) {
+	h := fnv.New64a()
+	h.Write(item)
+	sum := h.Sum64()
+	fp := cuckooFingerprint(sum & 0xffff)
+	if fp == 0 {
+		// reserve 0 to mark an empty slot
+		fp = 1
+	}
+	idx := (sum >> 16) % numBuckets
+	return fp, idx
+}
+
+// altIndex returns the other candidate bucket for a given index and
+// fingerprint. Deriving it by XOR-ing the index with a hash of the
+// fingerprint (rather than re-hashing the original item) is the "partial
+// key" trick: it makes the operation its own inverse, so an item can be
+// relocated between its two buckets using only its fingerprint.
+func altIndex(idx uint64, fp cuckooFingerprint, numBuckets uint64) uint64 {
+	h := fnv.New32a()
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], uint16(fp))
+	h.Write(b[:])
+	return (idx ^ uint64(h.Sum32())) % numBuckets
+}
+
+// Check returns true if item is (probably) present in the filter.
+func (c *CuckooFilter) Check(item []byte) bool {
+	c.Lock()
+	defer c.Unlock()
+	numBuckets := uint64(len(c.buckets))
+	fp, i1 := fingerprintAndIndex(item, numBuckets)
+	i2 := altIndex(i1, fp, numBuckets)
+	return c.buckets[i1].has(fp) || c.buckets[i2].has(fp)
+}
+
+// Add inserts item into the filter, relocating existing entries (up to
+// cuckooMaxRelocations times) if both of its candidate buckets are full.
+// If no free slot is found within the relocation limit, item itself ends
+// up stored (it has already been swapped into a bucket by that point),
+// but whichever fingerprint was last displaced in the relocation chain
+// could not be rehomed and is lost. That is a straight swap (one
+// previously stored indicator for the new one), so the total number of
+// stored items, and therefore count, does not change; the eviction is
+// tallied in evictions instead, so operators can see it happening via
+// EvictionCount without Len() drifting from the filter's actual
+// contents.
+func (c *CuckooFilter) Add(item []byte) {
+	c.Lock()
+	defer c.Unlock()
+	numBuckets := uint64(len(c.buckets))
+	fp, i1 := fingerprintAndIndex(item, numBuckets)
+	i2 := altIndex(i1, fp, numBuckets)
+
+	if c.buckets[i1].insert(fp) || c.buckets[i2].insert(fp) {
+		c.count++
+		return
+	}
+
+	idx := i1
+	if rand.Intn(2) == 1 {
+		idx = i2
+	}
+	for n := 0; n < cuckooMaxRelocations; n++ {
+		victim := rand.Intn(cuckooBucketSize)
+		fp, c.buckets[idx][victim] = c.buckets[idx][victim], fp
+		idx = altIndex(idx, fp, numBuckets)
+		if c.buckets[idx].insert(fp) {
+			c.count++
+			return
+		}
+	}
+	c.evictions++
+	log.Warn("cuckoo filter full, evicted a previously stored indicator after hitting relocation limit")
+}
+
+// EvictionCount returns the number of previously stored indicators that
+// have been permanently evicted from the filter after Add exhausted its
+// relocation budget looking for a free slot.
+func (c *CuckooFilter) EvictionCount() uint64 {
+	c.Lock()
+	defer c.Unlock()
+	return c.evictions
+}
+
+// Delete removes one occurrence of item from the filter, if present.
+func (c *CuckooFilter) Delete(item []byte) {
+	c.Lock()
+	defer c.Unlock()
+	numBuckets := uint64(len(c.buckets))
+	fp, i1 := fingerprintAndIndex(item, numBuckets)
+	i2 := altIndex(i1, fp, numBuckets)
+	if c.buckets[i1].remove(fp) || c.buckets[i2].remove(fp) {
+		c.count--
+	}
+}
+
+// Len returns the number of items currently stored in the filter.
+func (c *CuckooFilter) Len() uint64 {
+	c.Lock()
+	defer c.Unlock()
+	return c.count
+}
+
+// Reload reloads the filter's contents from its backing file.
+func (c *CuckooFilter) Reload() error {
+	if c.filename == "" {
+		return &BloomNoFileErr{"filter was not created from a file, no reloading possible"}
+	}
+	reloaded, err := LoadCuckooFilter(c.filename)
+	if err != nil {
+		return err
+	}
+	c.Lock()
+	c.buckets = reloaded.buckets
+	c.count = reloaded.count
+	c.Unlock()
+	return nil
+}
+
+// LoadCuckooFilter reads a CuckooFilter previously written by Save from
+// filename.
+func LoadCuckooFilter(filename string) (*CuckooFilter, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+
+	magic := make([]byte, len(cuckooFileMagic))
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(magic, cuckooFileMagic) {
+		return nil, fmt.Errorf("'%s' is not a Cuckoo filter file", filename)
+	}
+
+	var numBuckets, count uint64
+	if err := binary.Read(r, binary.BigEndian, &numBuckets); err != nil {
+		return nil, err
+	}
+	if err := binary.Read(r, binary.BigEndian, &count); err != nil {
+		return nil, err
+	}
+
+	cf := &CuckooFilter{
+		buckets:  make([]cuckooBucket, numBuckets),
+		count:    count,
+		filename: filename,
+	}
+	for i := range cf.buckets {
+		for j := 0; j < cuckooBucketSize; j++ {
+			var v uint16
+			if err := binary.Read(r, binary.BigEndian, &v); err != nil {
+				return nil, err
+			}
+			cf.buckets[i][j] = cuckooFingerprint(v)
+		}
+	}
+	return cf, nil
+}
+
+// Save persists the filter to filename in the format read by
+// LoadCuckooFilter, prefixed with cuckooFileMagic so it can be told apart
+// from a legacy Bloom filter file.
+func (c *CuckooFilter) Save(filename string) error {
+	c.Lock()
+	defer c.Unlock()
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+
+	if _, err := w.Write(cuckooFileMagic); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.BigEndian, uint64(len(c.buckets))); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.BigEndian, c.count); err != nil {
+		return err
+	}
+	for _, b := range c.buckets {
+		for _, fp := range b {
+			if err := binary.Write(w, binary.BigEndian, uint16(fp)); err != nil {
+				return err
+			}
+		}
+	}
+	return w.Flush()
+}
+
+// fileHasCuckooMagic peeks at the first bytes of filename to determine
+// whether it is a Cuckoo filter file (as opposed to a legacy Bloom filter
+// file, which carries no such header). An empty file is reported via
+// io.EOF, matching the behavior callers already expect from an empty
+// Bloom filter file.
+func fileHasCuckooMagic(filename string) (bool, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	header := make([]byte, len(cuckooFileMagic))
+	if _, err := io.ReadFull(f, header); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return false, io.EOF
+		}
+		return false, err
+	}
+	return bytes.Equal(header, cuckooFileMagic), nil
+}
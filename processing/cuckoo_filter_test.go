@@ -0,0 +1,56 @@
+package processing
+
+// DCSO FEVER
+// Copyright (c) 2017, 2020, DCSO GmbH
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestCuckooFilterAddCheckDelete(t *testing.T) {
+	c := MakeCuckooFilter(16)
+
+	if c.Check([]byte("example.com")) {
+		t.Fatalf("Check() = true for an item never added")
+	}
+
+	c.Add([]byte("example.com"))
+	if !c.Check([]byte("example.com")) {
+		t.Fatalf("Check() = false right after Add()")
+	}
+	if c.Len() != 1 {
+		t.Fatalf("Len() = %d, want 1", c.Len())
+	}
+
+	c.Delete([]byte("example.com"))
+	if c.Check([]byte("example.com")) {
+		t.Fatalf("Check() = true after Delete()")
+	}
+	if c.Len() != 0 {
+		t.Fatalf("Len() = %d, want 0 after Delete()", c.Len())
+	}
+}
+
+// TestCuckooFilterRelocationAccounting fills a deliberately small filter
+// well past its relocation limit. A relocation-exhausted Add swaps its new
+// item into a bucket in place of the indicator it ultimately evicts, so
+// the filter's physical occupancy never changes on that path: Len() must
+// never exceed the filter's total slot capacity, and hitting the
+// relocation limit repeatedly must still show up via EvictionCount.
+func TestCuckooFilterRelocationAccounting(t *testing.T) {
+	c := MakeCuckooFilter(4)
+	const n = 2000
+	capacity := uint64(len(c.buckets) * cuckooBucketSize)
+
+	for i := 0; i < n; i++ {
+		c.Add([]byte(fmt.Sprintf("indicator-%d", i)))
+	}
+
+	if evictions := c.EvictionCount(); evictions == 0 {
+		t.Fatalf("EvictionCount() = 0, want at least one eviction after overfilling a 4-bucket filter with %d items", n)
+	}
+	if got := c.Len(); got > capacity {
+		t.Fatalf("Len() = %d, want at most the filter's capacity of %d", got, capacity)
+	}
+}
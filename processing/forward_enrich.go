@@ -0,0 +1,119 @@
+package processing
+
+// DCSO FEVER
+// Copyright (c) 2017, 2020, DCSO GmbH
+
+import (
+	"crypto/tls"
+	"fmt"
+	"time"
+
+	"github.com/DCSO/fever/types"
+	"github.com/DCSO/fever/util"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// forwardEnricher bundles the enrichment steps (event type filtering,
+// flow marking, reverse DNS, added fields, Stenosis ownership) shared by
+// every sink that forwards EVE events verbatim, such as ForwardHandler and
+// KafkaForwardHandler.
+type forwardEnricher struct {
+	Logger            *log.Entry
+	DoRDNS            bool
+	RDNSHandler       *RDNSHandler
+	AddedFields       string
+	StenosisIface     string
+	StenosisConnector *StenosisConnector
+}
+
+// EnableRDNS switches on reverse DNS enrichment for source and destination
+// IPs in outgoing EVE events.
+func (fe *forwardEnricher) EnableRDNS(expiryPeriod time.Duration) {
+	fe.DoRDNS = true
+	fe.RDNSHandler = MakeRDNSHandler(util.NewHostNamerRDNS(expiryPeriod, 2*expiryPeriod))
+}
+
+// AddFields enables the addition of a custom set of top-level fields to the
+// forwarded JSON.
+func (fe *forwardEnricher) AddFields(fields map[string]string) error {
+	j := ""
+	// We preprocess the JSON to be able to only use fast string operations
+	// later. This code progressively builds a JSON snippet by adding JSON
+	// key-value pairs for each added field, e.g. `, "foo":"bar"`.
+	for k, v := range fields {
+		// Escape the fields to make sure we do not mess up the JSON when
+		// encountering weird symbols in field names or values.
+		kval, err := util.EscapeJSON(k)
+		if err != nil {
+			fe.Logger.Warningf("cannot escape value: %s", v)
+			return err
+		}
+		vval, err := util.EscapeJSON(v)
+		if err != nil {
+			fe.Logger.Warningf("cannot escape value: %s", v)
+			return err
+		}
+		j += fmt.Sprintf(",%s:%s", kval, vval)
+	}
+	// We finish the list of key-value pairs with a final brace:
+	// `, "foo":"bar"}`. This string can now just replace the final brace in a
+	// given JSON string. If there were no added fields, we just leave the
+	// output at the final brace.
+	j += "}"
+	fe.AddedFields = j
+	return nil
+}
+
+// enableStenosis wires up a Stenosis connector that takes ownership of
+// alert events on the given interface, emitting their enriched JSON onto
+// outputChan once resolved. It backs the EnableStenosis method each
+// concrete sink exposes with its own output channel.
+func (fe *forwardEnricher) enableStenosis(endpoint string, timeout, timeBracket time.Duration,
+	notifyChan chan types.Entry, outputChan chan []byte, cacheExpiry time.Duration,
+	tlsConfig *tls.Config, iface string) (err error) {
+	fe.StenosisConnector, err = MakeStenosisConnector(endpoint, timeout, timeBracket,
+		notifyChan, outputChan, cacheExpiry, tlsConfig)
+	fe.StenosisIface = iface
+	return
+}
+
+// enrichAndSerialize applies event type filtering, flow marking, reverse
+// DNS enrichment and added fields to e, and hands alerts over to the
+// Stenosis connector if one is configured for e's interface. It returns a
+// nil payload if e should not be forwarded to the sink at all.
+func (fe *forwardEnricher) enrichAndSerialize(e *types.Entry) ([]byte, error) {
+	if !(util.ForwardAllEvents || util.AllowType(e.EventType)) {
+		return nil, nil
+	}
+	// mark flow as relevant when alert is seen
+	if GlobalContextCollector != nil && e.EventType == types.EventTypeAlert {
+		GlobalContextCollector.Mark(string(e.FlowID))
+	}
+	// we also perform active rDNS enrichment if requested
+	if fe.DoRDNS && fe.RDNSHandler != nil {
+		if err := fe.RDNSHandler.Consume(e); err != nil {
+			return nil, err
+		}
+	}
+	// Replace the final brace `}` in the JSON with the prepared string to
+	// add the 'added fields' defined in the config. If the length of this
+	// string is 1 then there are no added fields, only a final brace '}'.
+	// In this case we don't even need to modify the JSON string at all.
+	if len(fe.AddedFields) > 1 {
+		j := e.JSONLine
+		l := len(j)
+		j = j[:l-1]
+		j += fe.AddedFields
+		e.JSONLine = j
+	}
+	// if we use Stenosis, the Stenosis connector will take ownership of
+	// alerts
+	if fe.StenosisConnector != nil &&
+		e.EventType == types.EventTypeAlert &&
+		(fe.StenosisIface == "*" || e.Iface == fe.StenosisIface) {
+		fe.StenosisConnector.Accept(e)
+		return nil, nil
+	}
+	return []byte(e.JSONLine), nil
+}
@@ -4,9 +4,15 @@ package processing
 // Copyright (c) 2017, 2020, DCSO GmbH
 
 import (
+	"bytes"
+	"compress/gzip"
 	"crypto/tls"
+	"encoding/binary"
 	"fmt"
+	"io"
 	"net"
+	"net/url"
+	"strings"
 	"sync"
 	"time"
 
@@ -20,22 +26,37 @@ import (
 // for monitoring.
 type ForwardHandlerPerfStats struct {
 	ForwardedPerSec uint64 `influx:"forwarded_events_per_sec"`
+	BatchesPerSec   uint64 `influx:"batches_per_sec"`
+	BytesOutPerSec  uint64 `influx:"bytes_out_per_sec"`
+	AvgBatchSize    uint64 `influx:"avg_batch_size"`
 }
 
+// ForwardFraming selects how individual events are delimited within a
+// flushed batch.
+type ForwardFraming int
+
+const (
+	// FramingNewline writes one JSON document per line, as FEVER has
+	// always done for unbatched output.
+	FramingNewline ForwardFraming = iota
+	// FramingLengthPrefixed prefixes every event with its length as a
+	// 4-byte big-endian integer, allowing a receiver to demultiplex the
+	// stream without relying on newlines not occurring inside a payload.
+	FramingLengthPrefixed
+)
+
 // ForwardHandler is a handler that processes events by writing their JSON
 // representation into a UNIX socket. This is limited by a list of allowed
 // event types to be forwarded.
 type ForwardHandler struct {
-	Logger              *log.Entry
-	DoRDNS              bool
-	RDNSHandler         *RDNSHandler
-	AddedFields         string
+	forwardEnricher
 	ContextCollector    *ContextCollector
-	StenosisIface       string
-	StenosisConnector   *StenosisConnector
 	ForwardEventChan    chan []byte
 	FlowNotifyChan      chan types.Entry
 	OutputSocket        string
+	OutputScheme        string
+	OutputAddress       string
+	OutputTLSConfig     *tls.Config
 	OutputConn          net.Conn
 	Reconnecting        bool
 	ReconnLock          sync.Mutex
@@ -43,20 +64,61 @@ type ForwardHandler struct {
 	StopReconnectChan   chan bool
 	ReconnectTimes      int
 	PerfStats           ForwardHandlerPerfStats
-	StatsEncoder        *util.PerformanceStatsEncoder
+	StatsEncoder        util.StatsEncoder
 	StopChan            chan bool
 	StoppedChan         chan bool
 	StopCounterChan     chan bool
 	StoppedCounterChan  chan bool
 	Running             bool
 	Lock                sync.Mutex
+	BatchingEnabled     bool
+	BatchMaxEvents      int
+	BatchMaxBytes       int
+	BatchFlushInterval  time.Duration
+	BatchCompress       bool
+	BatchFraming        ForwardFraming
+}
+
+// parseOutputTarget splits a forwarding target into a network scheme
+// ("unix", "tcp" or "tls") and the address to dial. A target with no
+// scheme prefix (e.g. a plain socket path) is treated as "unix" for
+// backwards compatibility with existing configurations.
+func parseOutputTarget(target string) (scheme string, address string, err error) {
+	if !strings.Contains(target, "://") {
+		return "unix", target, nil
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		return "", "", err
+	}
+	switch u.Scheme {
+	case "unix":
+		return "unix", u.Path, nil
+	case "tcp", "tls":
+		return u.Scheme, u.Host, nil
+	default:
+		return "", "", fmt.Errorf("unsupported output scheme '%s'", u.Scheme)
+	}
+}
+
+// dialOutput connects to the configured output target, using plain TCP,
+// TLS or a UNIX socket depending on the scheme parsed from OutputSocket.
+func (fh *ForwardHandler) dialOutput() (net.Conn, error) {
+	switch fh.OutputScheme {
+	case "tls":
+		return tls.Dial("tcp", fh.OutputAddress, fh.OutputTLSConfig)
+	case "tcp":
+		return net.Dial("tcp", fh.OutputAddress)
+	default:
+		return net.Dial("unix", fh.OutputAddress)
+	}
 }
 
 func (fh *ForwardHandler) reconnectForward() {
 	for range fh.ReconnectNotifyChan {
 		var i int
 		log.Info("Reconnecting to forwarding socket...")
-		outputConn, myerror := net.Dial("unix", fh.OutputSocket)
+		outputConn, myerror := fh.dialOutput()
 		fh.ReconnLock.Lock()
 		if !fh.Reconnecting {
 			fh.Reconnecting = true
@@ -76,7 +138,7 @@ func (fh *ForwardHandler) reconnectForward() {
 					"maxretries": fh.ReconnectTimes,
 				}).Warnf("error connecting to output socket, retrying: %s", myerror)
 				time.Sleep(10 * time.Second)
-				outputConn, myerror = net.Dial("unix", fh.OutputSocket)
+				outputConn, myerror = fh.dialOutput()
 			}
 		}
 		if myerror != nil {
@@ -101,7 +163,145 @@ func (fh *ForwardHandler) reconnectForward() {
 	}
 }
 
+// serializeBatch frames and, if enabled, gzip-compresses a batch of
+// forwarded events into a single payload ready to be written to the
+// output connection. Each batch is wrapped in its own gzip member (rather
+// than one long-lived stream) so that a reader which lost sync can simply
+// skip to the next batch boundary to resynchronize.
+func (fh *ForwardHandler) serializeBatch(batch [][]byte) ([]byte, error) {
+	var buf bytes.Buffer
+	var out io.Writer = &buf
+	var gzw *gzip.Writer
+	if fh.BatchCompress {
+		gzw = gzip.NewWriter(&buf)
+		out = gzw
+	}
+	for _, item := range batch {
+		if fh.BatchFraming == FramingLengthPrefixed {
+			var lenBytes [4]byte
+			binary.BigEndian.PutUint32(lenBytes[:], uint32(len(item)))
+			if _, err := out.Write(lenBytes[:]); err != nil {
+				return nil, err
+			}
+			if _, err := out.Write(item); err != nil {
+				return nil, err
+			}
+		} else {
+			if _, err := out.Write(item); err != nil {
+				return nil, err
+			}
+			if _, err := out.Write([]byte("\n")); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if gzw != nil {
+		if err := gzw.Close(); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// flushBatch serializes and writes a batch to the output connection,
+// triggering a reconnect on write failure exactly like the unbatched write
+// path does. It returns true if the batch was actually written (or was
+// empty to begin with), and false if it still needs to be flushed, so the
+// caller can hold on to it across a reconnect instead of discarding it. A
+// batch that cannot be serialized is logged and dropped, also returning
+// true.
+func (fh *ForwardHandler) flushBatch(batch [][]byte) bool {
+	if len(batch) == 0 {
+		return true
+	}
+	fh.ReconnLock.Lock()
+	if fh.Reconnecting {
+		fh.ReconnLock.Unlock()
+		return false
+	}
+	fh.ReconnLock.Unlock()
+	payload, err := fh.serializeBatch(batch)
+	if err != nil {
+		log.Warnf("could not serialize forward batch: %s", err)
+		return true
+	}
+	fh.Lock.Lock()
+	defer fh.Lock.Unlock()
+	if fh.OutputConn == nil {
+		return false
+	}
+	if _, err = fh.OutputConn.Write(payload); err != nil {
+		fh.OutputConn.Close()
+		log.Warn(err)
+		fh.ReconnectNotifyChan <- true
+		return false
+	}
+	fh.PerfStats.BatchesPerSec++
+	fh.PerfStats.BytesOutPerSec += uint64(len(payload))
+	return true
+}
+
+// batchHoldLimitFactor bounds how far an unflushed batch is allowed to
+// grow past BatchMaxEvents while it is held across a reconnect. Without a
+// cap, a prolonged outage under sustained throughput would grow the held
+// batch without bound; past this limit, runForwardBatched falls back to
+// dropping the newest events instead, the same trade-off the unbatched
+// write path has always made on reconnect.
+const batchHoldLimitFactor = 10
+
+// runForwardBatched buffers entries read from ForwardEventChan and flushes
+// them as a single framed (and optionally gzip-compressed) write whenever
+// the configured event count, byte size or flush interval threshold is
+// reached, or when Stop is called.
+func (fh *ForwardHandler) runForwardBatched() {
+	batch := make([][]byte, 0, fh.BatchMaxEvents)
+	batchBytes := 0
+	flushInterval := fh.BatchFlushInterval
+	if flushInterval <= 0 {
+		flushInterval = minBatchFlushInterval
+	}
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	flush := func() {
+		if fh.flushBatch(batch) {
+			batch = batch[:0]
+			batchBytes = 0
+		}
+	}
+
+	for {
+		select {
+		case <-fh.StopChan:
+			flush()
+			close(fh.StoppedChan)
+			return
+		case <-ticker.C:
+			flush()
+		case item, ok := <-fh.ForwardEventChan:
+			if !ok {
+				flush()
+				close(fh.StoppedChan)
+				return
+			}
+			if holdLimit := fh.BatchMaxEvents * batchHoldLimitFactor; holdLimit > 0 && len(batch) >= holdLimit {
+				log.Warn("forward batch held across reconnect hit its hard size limit, dropping event")
+				continue
+			}
+			batch = append(batch, item)
+			batchBytes += len(item)
+			if len(batch) >= fh.BatchMaxEvents || batchBytes >= fh.BatchMaxBytes {
+				flush()
+			}
+		}
+	}
+}
+
 func (fh *ForwardHandler) runForward() {
+	if fh.BatchingEnabled {
+		fh.runForwardBatched()
+		return
+	}
 	var err error
 	for {
 		select {
@@ -155,7 +355,7 @@ func (fh *ForwardHandler) runCounter() {
 			close(fh.StoppedCounterChan)
 			return
 		default:
-			if fh.StatsEncoder == nil || time.Since(sTime) < fh.StatsEncoder.SubmitPeriod {
+			if fh.StatsEncoder == nil || time.Since(sTime) < fh.StatsEncoder.GetSubmitPeriod() {
 				continue
 			}
 			// Lock the current measurements for submission. Since this is a blocking
@@ -165,28 +365,53 @@ func (fh *ForwardHandler) runCounter() {
 			// one as quickly as possible.
 			fh.Lock.Lock()
 			// Make our own copy of the current counter
-			myStats := ForwardHandlerPerfStats{
-				ForwardedPerSec: fh.PerfStats.ForwardedPerSec,
-			}
-			myStats.ForwardedPerSec /= uint64(fh.StatsEncoder.SubmitPeriod.Seconds())
-			// Reset live counter
+			rawForwarded := fh.PerfStats.ForwardedPerSec
+			rawBatches := fh.PerfStats.BatchesPerSec
+			rawBytes := fh.PerfStats.BytesOutPerSec
+			// Reset live counters
 			fh.PerfStats.ForwardedPerSec = 0
+			fh.PerfStats.BatchesPerSec = 0
+			fh.PerfStats.BytesOutPerSec = 0
 			// Release live counter to not block further events
 			fh.Lock.Unlock()
 
+			periodSecs := uint64(fh.StatsEncoder.GetSubmitPeriod().Seconds())
+			myStats := ForwardHandlerPerfStats{
+				ForwardedPerSec: rawForwarded / periodSecs,
+				BatchesPerSec:   rawBatches / periodSecs,
+				BytesOutPerSec:  rawBytes / periodSecs,
+			}
+			if rawBatches > 0 {
+				myStats.AvgBatchSize = rawForwarded / rawBatches
+			}
+
 			fh.StatsEncoder.Submit(myStats)
 			sTime = time.Now()
 		}
 	}
 }
 
-// MakeForwardHandler creates a new forwarding handler
-func MakeForwardHandler(reconnectTimes int, outputSocket string) *ForwardHandler {
-	fh := &ForwardHandler{
-		Logger: log.WithFields(log.Fields{
+// MakeForwardHandler creates a new forwarding handler. outputTarget is a
+// URL-style target describing where to forward events to, e.g.
+// `unix:///var/run/sock`, `tcp://siem:9000` or `tls://siem:9000`. A bare
+// path without a scheme is interpreted as a UNIX socket for backwards
+// compatibility.
+func MakeForwardHandler(reconnectTimes int, outputTarget string) *ForwardHandler {
+	scheme, address, err := parseOutputTarget(outputTarget)
+	if err != nil {
+		log.WithFields(log.Fields{
 			"domain": "forward",
-		}),
-		OutputSocket:        outputSocket,
+		}).Fatalf("invalid forwarding output target '%s': %s", outputTarget, err)
+	}
+	fh := &ForwardHandler{
+		forwardEnricher: forwardEnricher{
+			Logger: log.WithFields(log.Fields{
+				"domain": "forward",
+			}),
+		},
+		OutputSocket:        outputTarget,
+		OutputScheme:        scheme,
+		OutputAddress:       address,
 		ReconnectTimes:      reconnectTimes,
 		ReconnectNotifyChan: make(chan bool),
 		StopReconnectChan:   make(chan bool),
@@ -194,46 +419,60 @@ func MakeForwardHandler(reconnectTimes int, outputSocket string) *ForwardHandler
 	return fh
 }
 
+// EnableOutputTLS configures the TLS client settings (CA, client
+// certificate, SNI, certificate verification) to use when the output
+// target uses the `tls://` scheme. It has no effect for other schemes.
+func (fh *ForwardHandler) EnableOutputTLS(tlsConfig *tls.Config) {
+	fh.OutputTLSConfig = tlsConfig
+}
+
+// minBatchFlushInterval is the floor applied to a configured
+// flushInterval of zero or less, which would otherwise be handed
+// straight to time.NewTicker and panic.
+const minBatchFlushInterval = 100 * time.Millisecond
+
+// EnableBatching switches the forwarder from one write per event to
+// batched output. Events pulled from ForwardEventChan are buffered and
+// flushed as a single write once maxEvents or maxBytes is reached, or
+// flushInterval elapses, whichever happens first. Any remaining partial
+// batch is flushed on Stop. When compress is true, each flushed batch is
+// wrapped in its own gzip member. A flushInterval of zero or less is
+// raised to minBatchFlushInterval instead of being passed to the
+// underlying ticker.
+func (fh *ForwardHandler) EnableBatching(maxEvents int, maxBytes int, flushInterval time.Duration, compress bool) {
+	if flushInterval <= 0 {
+		log.Warnf("batch flush interval %s is not positive, using %s instead", flushInterval, minBatchFlushInterval)
+		flushInterval = minBatchFlushInterval
+	}
+	fh.BatchingEnabled = true
+	fh.BatchMaxEvents = maxEvents
+	fh.BatchMaxBytes = maxBytes
+	fh.BatchFlushInterval = flushInterval
+	fh.BatchCompress = compress
+}
+
+// EnableLengthPrefixFraming switches batched output from the default
+// newline-delimited JSON framing to frames prefixed with a 4-byte
+// big-endian length, so a receiver can demultiplex the stream without
+// relying on newlines not occurring inside a payload.
+func (fh *ForwardHandler) EnableLengthPrefixFraming() {
+	fh.BatchFraming = FramingLengthPrefixed
+}
+
 // Consume processes an Entry and prepares it to be sent off to the
 // forwarding sink
 func (fh *ForwardHandler) Consume(e *types.Entry) error {
-	doForwardThis := util.ForwardAllEvents || util.AllowType(e.EventType)
-	if doForwardThis {
-		// mark flow as relevant when alert is seen
-		if GlobalContextCollector != nil && e.EventType == types.EventTypeAlert {
-			GlobalContextCollector.Mark(string(e.FlowID))
-		}
-		// we also perform active rDNS enrichment if requested
-		if fh.DoRDNS && fh.RDNSHandler != nil {
-			err := fh.RDNSHandler.Consume(e)
-			if err != nil {
-				return err
-			}
-		}
-		// Replace the final brace `}` in the JSON with the prepared string to
-		// add the 'added fields' defined in the config. I the length of this
-		// string is 1 then there are no added fields, only a final brace '}'.
-		// In this case we don't even need to modify the JSON string at all.
-		if len(fh.AddedFields) > 1 {
-			j := e.JSONLine
-			l := len(j)
-			j = j[:l-1]
-			j += fh.AddedFields
-			e.JSONLine = j
-		}
-		// if we use Stenosis, the Stenosis connector will take ownership of
-		// alerts
-		if fh.StenosisConnector != nil &&
-			e.EventType == types.EventTypeAlert &&
-			(fh.StenosisIface == "*" || e.Iface == fh.StenosisIface) {
-			fh.StenosisConnector.Accept(e)
-		} else {
-			fh.ForwardEventChan <- []byte(e.JSONLine)
-			fh.Lock.Lock()
-			fh.PerfStats.ForwardedPerSec++
-			fh.Lock.Unlock()
-		}
+	payload, err := fh.enrichAndSerialize(e)
+	if err != nil {
+		return err
+	}
+	if payload == nil {
+		return nil
 	}
+	fh.ForwardEventChan <- payload
+	fh.Lock.Lock()
+	fh.PerfStats.ForwardedPerSec++
+	fh.Lock.Unlock()
 	return nil
 }
 
@@ -251,51 +490,13 @@ func (fh *ForwardHandler) GetEventTypes() []string {
 	return util.GetAllowedTypes()
 }
 
-// EnableRDNS switches on reverse DNS enrichment for source and destination
-// IPs in outgoing EVE events.
-func (fh *ForwardHandler) EnableRDNS(expiryPeriod time.Duration) {
-	fh.DoRDNS = true
-	fh.RDNSHandler = MakeRDNSHandler(util.NewHostNamerRDNS(expiryPeriod, 2*expiryPeriod))
-}
-
-// AddFields enables the addition of a custom set of top-level fields to the
-// forwarded JSON.
-func (fh *ForwardHandler) AddFields(fields map[string]string) error {
-	j := ""
-	// We preprocess the JSON to be able to only use fast string operations
-	// later. This code progressively builds a JSON snippet by adding JSON
-	// key-value pairs for each added field, e.g. `, "foo":"bar"`.
-	for k, v := range fields {
-		// Escape the fields to make sure we do not mess up the JSON when
-		// encountering weird symbols in field names or values.
-		kval, err := util.EscapeJSON(k)
-		if err != nil {
-			fh.Logger.Warningf("cannot escape value: %s", v)
-			return err
-		}
-		vval, err := util.EscapeJSON(v)
-		if err != nil {
-			fh.Logger.Warningf("cannot escape value: %s", v)
-			return err
-		}
-		j += fmt.Sprintf(",%s:%s", kval, vval)
-	}
-	// We finish the list of key-value pairs with a final brace:
-	// `, "foo":"bar"}`. This string can now just replace the final brace in a
-	// given JSON string. If there were no added fields, we just leave the
-	// output at the final brace.
-	j += "}"
-	fh.AddedFields = j
-	return nil
-}
-
-// EnableStenosis ...
+// EnableStenosis configures a Stenosis connector that takes ownership of
+// alerts seen on iface, emitting their enriched JSON onto this handler's
+// forwarding channel once resolved.
 func (fh *ForwardHandler) EnableStenosis(endpoint string, timeout, timeBracket time.Duration,
 	notifyChan chan types.Entry, cacheExpiry time.Duration, tlsConfig *tls.Config, iface string) (err error) {
-	fh.StenosisConnector, err = MakeStenosisConnector(endpoint, timeout, timeBracket,
-		notifyChan, fh.ForwardEventChan, cacheExpiry, tlsConfig)
-	fh.StenosisIface = iface
-	return
+	return fh.enableStenosis(endpoint, timeout, timeBracket, notifyChan,
+		fh.ForwardEventChan, cacheExpiry, tlsConfig, iface)
 }
 
 // Run starts forwarding of JSON representations of all consumed events
@@ -329,7 +530,8 @@ func (fh *ForwardHandler) Stop(stoppedChan chan bool) {
 	}
 }
 
-// SubmitStats registers a PerformanceStatsEncoder for runtime stats submission.
-func (fh *ForwardHandler) SubmitStats(sc *util.PerformanceStatsEncoder) {
+// SubmitStats registers sc as the destination for this handler's periodic
+// PerfStats submission; see runCounter.
+func (fh *ForwardHandler) SubmitStats(sc util.StatsEncoder) {
 	fh.StatsEncoder = sc
 }
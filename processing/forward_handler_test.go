@@ -0,0 +1,157 @@
+package processing
+
+// DCSO FEVER
+// Copyright (c) 2017, 2020, DCSO GmbH
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSerializeBatch(t *testing.T) {
+	batch := [][]byte{
+		[]byte(`{"event_type":"alert","id":1}`),
+		[]byte(`{"event_type":"alert","id":2}`),
+		[]byte(`{"event_type":"alert","id":3}`),
+	}
+
+	for _, tc := range []struct {
+		name     string
+		framing  ForwardFraming
+		compress bool
+	}{
+		{"newline", FramingNewline, false},
+		{"newline gzip", FramingNewline, true},
+		{"length-prefixed", FramingLengthPrefixed, false},
+		{"length-prefixed gzip", FramingLengthPrefixed, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fh := &ForwardHandler{
+				BatchFraming:  tc.framing,
+				BatchCompress: tc.compress,
+			}
+			payload, err := fh.serializeBatch(batch)
+			if err != nil {
+				t.Fatalf("serializeBatch() error = %v", err)
+			}
+			raw := payload
+			if tc.compress {
+				gzr, err := gzip.NewReader(bytes.NewReader(payload))
+				if err != nil {
+					t.Fatalf("gzip.NewReader() error = %v", err)
+				}
+				raw, err = ioutil.ReadAll(gzr)
+				if err != nil {
+					t.Fatalf("reading gzip payload: %v", err)
+				}
+			}
+
+			var got [][]byte
+			if tc.framing == FramingLengthPrefixed {
+				for len(raw) > 0 {
+					if len(raw) < 4 {
+						t.Fatalf("truncated length prefix, %d bytes left", len(raw))
+					}
+					l := binary.BigEndian.Uint32(raw[:4])
+					raw = raw[4:]
+					if uint32(len(raw)) < l {
+						t.Fatalf("truncated frame, want %d bytes, have %d", l, len(raw))
+					}
+					got = append(got, raw[:l])
+					raw = raw[l:]
+				}
+			} else {
+				for _, line := range bytes.Split(bytes.TrimRight(raw, "\n"), []byte("\n")) {
+					got = append(got, line)
+				}
+			}
+
+			if len(got) != len(batch) {
+				t.Fatalf("got %d events, want %d", len(got), len(batch))
+			}
+			for i := range batch {
+				if !bytes.Equal(got[i], batch[i]) {
+					t.Errorf("event %d = %q, want %q", i, got[i], batch[i])
+				}
+			}
+		})
+	}
+}
+
+// TestRunForwardBatchedZeroMaxEventsStillFlushes guards against the
+// BatchMaxEvents*batchHoldLimitFactor hold-limit check degenerating to
+// "len(batch) >= 0" (always true) when batching is misconfigured with a
+// zero BatchMaxEvents, which would silently drop every event instead of
+// flushing it immediately as a zero threshold is supposed to do.
+func TestRunForwardBatchedZeroMaxEventsStillFlushes(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	defer clientConn.Close()
+
+	fh := &ForwardHandler{
+		OutputConn:          clientConn,
+		ForwardEventChan:    make(chan []byte, 10),
+		StopChan:            make(chan bool),
+		StoppedChan:         make(chan bool),
+		ReconnectNotifyChan: make(chan bool, 1),
+		BatchingEnabled:     true,
+		BatchMaxEvents:      0,
+		BatchMaxBytes:       0,
+		BatchFlushInterval:  time.Hour,
+	}
+	go fh.runForwardBatched()
+	defer func() {
+		close(fh.StopChan)
+		<-fh.StoppedChan
+	}()
+
+	fh.ForwardEventChan <- []byte(`{"event_type":"alert"}`)
+
+	serverConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 256)
+	n, err := serverConn.Read(buf)
+	if err != nil {
+		t.Fatalf("event was not flushed with BatchMaxEvents=0: %v", err)
+	}
+	if got := string(buf[:n]); got != "{\"event_type\":\"alert\"}\n" {
+		t.Errorf("flushed payload = %q, want the single event followed by a newline", got)
+	}
+}
+
+func TestEnableBatchingRejectsNonPositiveFlushInterval(t *testing.T) {
+	fh := &ForwardHandler{}
+	fh.EnableBatching(10, 1024, 0, false)
+	if fh.BatchFlushInterval != minBatchFlushInterval {
+		t.Fatalf("BatchFlushInterval = %s, want the %s floor for a zero interval", fh.BatchFlushInterval, minBatchFlushInterval)
+	}
+}
+
+// TestRunForwardBatchedNonPositiveFlushIntervalDoesNotPanic guards
+// time.NewTicker(fh.BatchFlushInterval) against a zero/negative interval
+// reaching runForwardBatched directly (bypassing EnableBatching's own
+// floor), which would otherwise panic and bring down the process.
+func TestRunForwardBatchedNonPositiveFlushIntervalDoesNotPanic(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	defer clientConn.Close()
+
+	fh := &ForwardHandler{
+		OutputConn:          clientConn,
+		ForwardEventChan:    make(chan []byte, 10),
+		StopChan:            make(chan bool),
+		StoppedChan:         make(chan bool),
+		ReconnectNotifyChan: make(chan bool, 1),
+		BatchingEnabled:     true,
+		BatchMaxEvents:      10,
+		BatchMaxBytes:       1024,
+		BatchFlushInterval:  0,
+	}
+	go fh.runForwardBatched()
+	close(fh.StopChan)
+	<-fh.StoppedChan
+}
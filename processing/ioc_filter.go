@@ -0,0 +1,26 @@
+package processing
+
+// DCSO FEVER
+// Copyright (c) 2017, 2020, DCSO GmbH
+
+// IOCFilter is implemented by set membership filters used to check
+// observed values (domains, URLs, SNIs, ...) against a list of
+// indicators of compromise (IOCs). It abstracts BloomHandler from the
+// concrete filter backend (classic Bloom filter, Cuckoo filter, ...) so
+// the on-disk artifact can be swapped without changing how FEVER is
+// invoked.
+type IOCFilter interface {
+	// Check returns true if item is (probably) present in the filter.
+	Check(item []byte) bool
+	// Add inserts item into the filter.
+	Add(item []byte)
+	// Delete removes item from the filter, if the backend supports
+	// deletion. Backends that don't (e.g. classic Bloom filters) treat
+	// this as a no-op.
+	Delete(item []byte)
+	// Len returns the number of items currently stored in the filter.
+	Len() uint64
+	// Reload reloads the filter's contents from its backing file, if it
+	// was loaded from one.
+	Reload() error
+}
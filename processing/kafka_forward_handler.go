@@ -0,0 +1,332 @@
+package processing
+
+// DCSO FEVER
+// Copyright (c) 2017, 2020, DCSO GmbH
+
+import (
+	"crypto/tls"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/DCSO/fever/types"
+	"github.com/DCSO/fever/util"
+
+	"github.com/Shopify/sarama"
+	log "github.com/sirupsen/logrus"
+)
+
+// KafkaPartitioning selects how events are distributed across a topic's
+// partitions.
+type KafkaPartitioning int
+
+const (
+	// KafkaPartitionRoundRobin spreads events evenly across partitions in
+	// turn, maximizing throughput when no particular ordering between
+	// events is required.
+	KafkaPartitionRoundRobin KafkaPartitioning = iota
+	// KafkaPartitionByFlow hashes on the event's flow ID, falling back to
+	// its source IP if no flow ID is set, so that all events belonging to
+	// the same flow land on the same partition and stay ordered relative
+	// to each other for a downstream consumer.
+	KafkaPartitionByFlow
+)
+
+// SASLConfig carries the credentials used to authenticate with a Kafka
+// broker via SASL.
+type SASLConfig struct {
+	Mechanism string
+	Username  string
+	Password  string
+}
+
+// KafkaForwardHandlerPerfStats contains performance stats written to
+// InfluxDB for monitoring.
+type KafkaForwardHandlerPerfStats struct {
+	ForwardedPerSec     uint64 `influx:"forwarded_events_per_sec"`
+	ProduceErrorsPerSec uint64 `influx:"produce_errors_per_sec"`
+}
+
+// kafkaForwardItem pairs a serialized event with the partition key derived
+// from it, so runProduce can still route it by flow/source IP even though
+// the originating types.Entry is gone by the time it reaches the producer.
+type kafkaForwardItem struct {
+	key   []byte
+	value []byte
+}
+
+// KafkaForwardHandler is a handler that forwards events' JSON
+// representation to a Kafka topic, reusing the rDNS/AddFields/Stenosis
+// enrichment logic also used by ForwardHandler.
+type KafkaForwardHandler struct {
+	forwardEnricher
+	Brokers      []string
+	Topic        string
+	SASL         *SASLConfig
+	TLSConfig    *tls.Config
+	Partitioning KafkaPartitioning
+
+	Producer         sarama.AsyncProducer
+	ForwardEventChan chan kafkaForwardItem
+	// StenosisChan is the plain byte channel handed to the Stenosis
+	// connector as its output, since a connector has no notion of the
+	// partition key a produced item may carry; a bridging goroutine
+	// started in Run wraps its output as a kafkaForwardItem.
+	StenosisChan   chan []byte
+	FlowNotifyChan chan types.Entry
+	// StenosisBridgeDoneChan is closed once bridgeStenosisChan has drained
+	// StenosisChan and returned, so Stop can close ForwardEventChan only
+	// after the bridge goroutine is guaranteed to no longer send to it.
+	StenosisBridgeDoneChan chan bool
+
+	PerfStats    KafkaForwardHandlerPerfStats
+	StatsEncoder util.StatsEncoder
+
+	StopChan           chan bool
+	StoppedChan        chan bool
+	StopCounterChan    chan bool
+	StoppedCounterChan chan bool
+	Running            bool
+	Lock               sync.Mutex
+}
+
+// MakeKafkaForwardHandler creates a new Kafka-backed forwarding handler
+// that produces to topic on the given brokers. partitioning selects how
+// events are spread across the topic's partitions. saslConfig and
+// tlsConfig are optional and may be nil.
+func MakeKafkaForwardHandler(brokers []string, topic string, partitioning KafkaPartitioning,
+	saslConfig *SASLConfig, tlsConfig *tls.Config) *KafkaForwardHandler {
+	kh := &KafkaForwardHandler{
+		forwardEnricher: forwardEnricher{
+			Logger: log.WithFields(log.Fields{
+				"domain": "kafkaforward",
+			}),
+		},
+		Brokers:      brokers,
+		Topic:        topic,
+		SASL:         saslConfig,
+		TLSConfig:    tlsConfig,
+		Partitioning: partitioning,
+	}
+	return kh
+}
+
+// buildProducerConfig translates the handler's configuration into a
+// sarama.Config, selecting the partitioner requested via Partitioning and
+// requiring acknowledgment from all in-sync replicas before a produce is
+// considered successful.
+func (kh *KafkaForwardHandler) buildProducerConfig() *sarama.Config {
+	cfg := sarama.NewConfig()
+	cfg.Producer.RequiredAcks = sarama.WaitForAll
+	cfg.Producer.Return.Successes = false
+	cfg.Producer.Return.Errors = true
+	if kh.Partitioning == KafkaPartitionByFlow {
+		cfg.Producer.Partitioner = sarama.NewHashPartitioner
+	} else {
+		cfg.Producer.Partitioner = sarama.NewRoundRobinPartitioner
+	}
+	if kh.TLSConfig != nil {
+		cfg.Net.TLS.Enable = true
+		cfg.Net.TLS.Config = kh.TLSConfig
+	}
+	if kh.SASL != nil {
+		cfg.Net.SASL.Enable = true
+		cfg.Net.SASL.Mechanism = sarama.SASLMechanism(kh.SASL.Mechanism)
+		cfg.Net.SASL.User = kh.SASL.Username
+		cfg.Net.SASL.Password = kh.SASL.Password
+	}
+	return cfg
+}
+
+// partitionKey returns the key used to route e to a partition when
+// KafkaPartitionByFlow is selected, preferring the flow ID and falling
+// back to the source IP if no flow is associated with the event.
+func partitionKey(e *types.Entry) []byte {
+	if e.FlowID != 0 {
+		return []byte(strconv.FormatUint(e.FlowID, 10))
+	}
+	return []byte(e.SrcIP)
+}
+
+// bridgeStenosisChan wraps everything Stenosis writes to StenosisChan as a
+// kafkaForwardItem with no partition key, forwarding it on to
+// ForwardEventChan. It returns once StenosisChan is closed, signalling so
+// via StenosisBridgeDoneChan so Stop can wait for it before closing
+// ForwardEventChan.
+func (kh *KafkaForwardHandler) bridgeStenosisChan() {
+	for v := range kh.StenosisChan {
+		kh.ForwardEventChan <- kafkaForwardItem{value: v}
+	}
+	close(kh.StenosisBridgeDoneChan)
+}
+
+// connect creates the underlying Kafka producer. Run calls this once;
+// sarama's AsyncProducer reconnects to brokers internally afterwards, so
+// there is no broker-reconnect event for FEVER itself to count here.
+func (kh *KafkaForwardHandler) connect() error {
+	producer, err := sarama.NewAsyncProducer(kh.Brokers, kh.buildProducerConfig())
+	if err != nil {
+		return err
+	}
+	kh.Lock.Lock()
+	kh.Producer = producer
+	kh.Lock.Unlock()
+	return nil
+}
+
+// runProduce feeds events read from ForwardEventChan into the Kafka
+// producer, and consumes its error channel to count produce failures for
+// monitoring. Each failure is logged with its partition, but the count is
+// a single total across all partitions, not one per partition.
+func (kh *KafkaForwardHandler) runProduce() {
+	go func() {
+		for perr := range kh.Producer.Errors() {
+			kh.Logger.WithFields(log.Fields{
+				"partition": perr.Msg.Partition,
+			}).Warnf("could not produce to Kafka: %s", perr.Err)
+			kh.Lock.Lock()
+			kh.PerfStats.ProduceErrorsPerSec++
+			kh.Lock.Unlock()
+		}
+	}()
+	for {
+		select {
+		case <-kh.StopChan:
+			close(kh.StoppedChan)
+			return
+		case item, ok := <-kh.ForwardEventChan:
+			if !ok {
+				close(kh.StoppedChan)
+				return
+			}
+			msg := &sarama.ProducerMessage{
+				Topic: kh.Topic,
+				Value: sarama.ByteEncoder(item.value),
+			}
+			if item.key != nil {
+				msg.Key = sarama.ByteEncoder(item.key)
+			}
+			kh.Producer.Input() <- msg
+			kh.Lock.Lock()
+			kh.PerfStats.ForwardedPerSec++
+			kh.Lock.Unlock()
+		}
+	}
+}
+
+func (kh *KafkaForwardHandler) runCounter() {
+	sTime := time.Now()
+	for {
+		time.Sleep(500 * time.Millisecond)
+		select {
+		case <-kh.StopCounterChan:
+			close(kh.StoppedCounterChan)
+			return
+		default:
+			if kh.StatsEncoder == nil || time.Since(sTime) < kh.StatsEncoder.GetSubmitPeriod() {
+				continue
+			}
+			kh.Lock.Lock()
+			rawForwarded := kh.PerfStats.ForwardedPerSec
+			rawErrors := kh.PerfStats.ProduceErrorsPerSec
+			kh.PerfStats.ForwardedPerSec = 0
+			kh.PerfStats.ProduceErrorsPerSec = 0
+			kh.Lock.Unlock()
+
+			periodSecs := uint64(kh.StatsEncoder.GetSubmitPeriod().Seconds())
+			kh.StatsEncoder.Submit(KafkaForwardHandlerPerfStats{
+				ForwardedPerSec:     rawForwarded / periodSecs,
+				ProduceErrorsPerSec: rawErrors / periodSecs,
+			})
+			kh.StatsEncoder.IncrCounter("kafka_produce_errors_total", nil, float64(rawErrors))
+			sTime = time.Now()
+		}
+	}
+}
+
+// Consume processes an Entry and hands its JSON representation over to
+// the Kafka producer.
+func (kh *KafkaForwardHandler) Consume(e *types.Entry) error {
+	payload, err := kh.enrichAndSerialize(e)
+	if err != nil {
+		return err
+	}
+	if payload == nil {
+		return nil
+	}
+	item := kafkaForwardItem{value: payload}
+	if kh.Partitioning == KafkaPartitionByFlow {
+		item.key = partitionKey(e)
+	}
+	kh.ForwardEventChan <- item
+	return nil
+}
+
+// GetName returns the name of the handler
+func (kh *KafkaForwardHandler) GetName() string {
+	return "Kafka forwarding handler"
+}
+
+// GetEventTypes returns a slice of event type strings that this handler
+// should be applied to
+func (kh *KafkaForwardHandler) GetEventTypes() []string {
+	if util.ForwardAllEvents {
+		return []string{"*"}
+	}
+	return util.GetAllowedTypes()
+}
+
+// EnableStenosis configures a Stenosis connector that takes ownership of
+// alerts seen on iface, emitting their enriched JSON onto StenosisChan,
+// which Run bridges back into the producer's input.
+func (kh *KafkaForwardHandler) EnableStenosis(endpoint string, timeout, timeBracket time.Duration,
+	notifyChan chan types.Entry, cacheExpiry time.Duration, tlsConfig *tls.Config, iface string) (err error) {
+	return kh.enableStenosis(endpoint, timeout, timeBracket, notifyChan,
+		kh.StenosisChan, cacheExpiry, tlsConfig, iface)
+}
+
+// Run starts forwarding of JSON representations of all consumed events to
+// the configured Kafka topic.
+func (kh *KafkaForwardHandler) Run() {
+	if !kh.Running {
+		if err := kh.connect(); err != nil {
+			kh.Logger.Fatalf("could not connect to Kafka brokers %v: %s", kh.Brokers, err)
+		}
+		kh.StopChan = make(chan bool)
+		kh.ForwardEventChan = make(chan kafkaForwardItem, 10000)
+		kh.StenosisChan = make(chan []byte, 10000)
+		kh.StopCounterChan = make(chan bool)
+		kh.StoppedCounterChan = make(chan bool)
+		kh.StenosisBridgeDoneChan = make(chan bool)
+		go kh.bridgeStenosisChan()
+		go kh.runProduce()
+		go kh.runCounter()
+		kh.Running = true
+	}
+}
+
+// Stop stops forwarding of JSON representations of all consumed events
+func (kh *KafkaForwardHandler) Stop(stoppedChan chan bool) {
+	if kh.Running {
+		close(kh.StopCounterChan)
+		<-kh.StoppedCounterChan
+		kh.StoppedChan = stoppedChan
+		// Closing StenosisChan and waiting for the bridge to drain it must
+		// happen before StopChan is closed: runProduce, which is still the
+		// only thing reading ForwardEventChan at this point, has to stay
+		// up so bridgeStenosisChan's sends on it can't block forever.
+		close(kh.StenosisChan)
+		<-kh.StenosisBridgeDoneChan
+		close(kh.StopChan)
+		close(kh.ForwardEventChan)
+		kh.Producer.Close()
+		kh.Running = false
+	}
+}
+
+// SubmitStats registers sc as the destination for this handler's
+// KafkaForwardHandlerPerfStats submission and kafka_produce_errors_total
+// counter.
+func (kh *KafkaForwardHandler) SubmitStats(sc util.StatsEncoder) {
+	kh.StatsEncoder = sc
+}
@@ -0,0 +1,36 @@
+package processing
+
+// DCSO FEVER
+// Copyright (c) 2017, 2020, DCSO GmbH
+
+import (
+	"testing"
+
+	"github.com/DCSO/fever/types"
+)
+
+func TestPartitionKey(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		e    *types.Entry
+		want string
+	}{
+		{"flow ID is preferred", &types.Entry{FlowID: 123456789, SrcIP: "10.0.0.1"}, "123456789"},
+		{"large flow ID stays distinct", &types.Entry{FlowID: 9876543210, SrcIP: "10.0.0.1"}, "9876543210"},
+		{"falls back to source IP with no flow", &types.Entry{FlowID: 0, SrcIP: "10.0.0.1"}, "10.0.0.1"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := string(partitionKey(tc.e)); got != tc.want {
+				t.Errorf("partitionKey() = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestPartitionKeyDistinctFlowsDoNotCollide(t *testing.T) {
+	a := partitionKey(&types.Entry{FlowID: 1234567890123})
+	b := partitionKey(&types.Entry{FlowID: 9876543210987})
+	if string(a) == string(b) {
+		t.Fatalf("partitionKey() collided for distinct flow IDs: %q", a)
+	}
+}
@@ -0,0 +1,84 @@
+package util
+
+// DCSO FEVER
+// Copyright (c) 2017, 2020, DCSO GmbH
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"reflect"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// PerformanceStatsEncoder submits periodic performance counter snapshots to
+// an InfluxDB-compatible HTTP endpoint using the line protocol. Structs
+// passed to Submit() are expected to carry `influx:"..."` tags on their
+// exported fields naming the corresponding measurement field.
+//
+// It satisfies util.StatsEncoder alongside PrometheusStatsEncoder, and
+// ForwardHandler uses it through that interface, calling GetSubmitPeriod
+// and Submit; IncrCounter and SetGauge are no-ops here.
+type PerformanceStatsEncoder struct {
+	URL          string
+	Measurement  string
+	SubmitPeriod time.Duration
+	Client       *http.Client
+}
+
+// MakePerformanceStatsEncoder creates a new PerformanceStatsEncoder
+// submitting to the given InfluxDB write URL under the given measurement
+// name, every submitPeriod.
+func MakePerformanceStatsEncoder(url string, measurement string, submitPeriod time.Duration) *PerformanceStatsEncoder {
+	return &PerformanceStatsEncoder{
+		URL:          url,
+		Measurement:  measurement,
+		SubmitPeriod: submitPeriod,
+		Client:       &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+// GetSubmitPeriod returns how often a handler should call Submit.
+func (p *PerformanceStatsEncoder) GetSubmitPeriod() time.Duration {
+	return p.SubmitPeriod
+}
+
+// Submit writes the fields of stats, which must carry `influx` tags, as a
+// single InfluxDB line protocol point.
+func (p *PerformanceStatsEncoder) Submit(stats interface{}) {
+	v := reflect.ValueOf(stats)
+	t := v.Type()
+	var fields bytes.Buffer
+	for i := 0; i < t.NumField(); i++ {
+		tag := t.Field(i).Tag.Get("influx")
+		if tag == "" {
+			continue
+		}
+		if fields.Len() > 0 {
+			fields.WriteByte(',')
+		}
+		fmt.Fprintf(&fields, "%s=%vi", tag, v.Field(i).Interface())
+	}
+	if fields.Len() == 0 {
+		return
+	}
+	line := fmt.Sprintf("%s %s\n", p.Measurement, fields.String())
+	resp, err := p.Client.Post(p.URL, "application/octet-stream", bytes.NewBufferString(line))
+	if err != nil {
+		log.Warnf("could not submit performance stats: %s", err)
+		return
+	}
+	resp.Body.Close()
+}
+
+// IncrCounter is a no-op for the InfluxDB encoder, which reports aggregate
+// snapshots via Submit() rather than individually labeled counters.
+func (p *PerformanceStatsEncoder) IncrCounter(name string, labels map[string]string, delta float64) {
+}
+
+// SetGauge is a no-op for the InfluxDB encoder, which reports aggregate
+// snapshots via Submit() rather than individually labeled gauges.
+func (p *PerformanceStatsEncoder) SetGauge(name string, labels map[string]string, value float64) {
+}
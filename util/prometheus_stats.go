@@ -0,0 +1,164 @@
+package util
+
+// DCSO FEVER
+// Copyright (c) 2017, 2020, DCSO GmbH
+
+import (
+	"net/http"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+)
+
+// PrometheusStatsEncoder exposes FEVER performance counters as Prometheus
+// metrics on a `/metrics` HTTP endpoint, as an alternative to submitting
+// them to InfluxDB via PerformanceStatsEncoder. It reflects over the same
+// `influx:"..."` tagged structs handlers already use for their InfluxDB
+// stats, registering a Gauge per field, and additionally lets handlers
+// maintain their own labeled counters/gauges (e.g. per event type).
+type PrometheusStatsEncoder struct {
+	Namespace    string
+	SubmitPeriod time.Duration
+
+	mu          sync.Mutex
+	registry    *prometheus.Registry
+	gauges      map[string]prometheus.Gauge
+	counterVecs map[string]*prometheus.CounterVec
+	gaugeVecs   map[string]*prometheus.GaugeVec
+}
+
+// MakePrometheusStatsEncoder creates a new PrometheusStatsEncoder and
+// starts serving `/metrics` on listenAddr. namespace is prefixed to every
+// metric name (e.g. "fever"). Each encoder registers its metrics on its
+// own prometheus.Registry rather than the global default one, so that
+// creating more than one encoder (e.g. in tests, or for two namespaces)
+// cannot panic with an AlreadyRegisteredError.
+func MakePrometheusStatsEncoder(listenAddr string, namespace string, submitPeriod time.Duration) *PrometheusStatsEncoder {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(prometheus.NewGoCollector())
+	registry.MustRegister(prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}))
+	pe := &PrometheusStatsEncoder{
+		Namespace:    namespace,
+		SubmitPeriod: submitPeriod,
+		registry:     registry,
+		gauges:       make(map[string]prometheus.Gauge),
+		counterVecs:  make(map[string]*prometheus.CounterVec),
+		gaugeVecs:    make(map[string]*prometheus.GaugeVec),
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(pe.registry, promhttp.HandlerOpts{}))
+	go func() {
+		log.WithFields(log.Fields{
+			"domain": "stats",
+		}).Infof("serving Prometheus metrics on %s/metrics", listenAddr)
+		if err := http.ListenAndServe(listenAddr, mux); err != nil {
+			log.WithFields(log.Fields{
+				"domain": "stats",
+			}).Errorf("Prometheus metrics listener failed: %s", err)
+		}
+	}()
+	return pe
+}
+
+// GetSubmitPeriod returns how often a handler should call Submit.
+func (pe *PrometheusStatsEncoder) GetSubmitPeriod() time.Duration {
+	return pe.SubmitPeriod
+}
+
+// Submit registers (on first use) and sets a Gauge for every field of
+// stats carrying an `influx` tag, using the tag value as the metric name.
+func (pe *PrometheusStatsEncoder) Submit(stats interface{}) {
+	v := reflect.ValueOf(stats)
+	t := v.Type()
+	pe.mu.Lock()
+	defer pe.mu.Unlock()
+	for i := 0; i < t.NumField(); i++ {
+		tag := t.Field(i).Tag.Get("influx")
+		if tag == "" {
+			continue
+		}
+		name := pe.Namespace + "_" + tag
+		g, ok := pe.gauges[name]
+		if !ok {
+			g = prometheus.NewGauge(prometheus.GaugeOpts{
+				Name: name,
+				Help: "FEVER performance counter " + tag,
+			})
+			pe.registry.MustRegister(g)
+			pe.gauges[name] = g
+		}
+		g.Set(toFloat64(v.Field(i)))
+	}
+}
+
+// IncrCounter increments a labeled counter metric by delta, registering it
+// on first use. All calls for a given name are expected to use the same
+// set of label keys.
+func (pe *PrometheusStatsEncoder) IncrCounter(name string, labels map[string]string, delta float64) {
+	labelNames, labelValues := sortedLabels(labels)
+	pe.mu.Lock()
+	defer pe.mu.Unlock()
+	cv, ok := pe.counterVecs[name]
+	if !ok {
+		cv = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: pe.Namespace + "_" + name,
+			Help: "FEVER counter " + name,
+		}, labelNames)
+		pe.registry.MustRegister(cv)
+		pe.counterVecs[name] = cv
+	}
+	cv.WithLabelValues(labelValues...).Add(delta)
+}
+
+// SetGauge sets a labeled gauge metric to value, registering it on first
+// use. All calls for a given name are expected to use the same set of
+// label keys.
+func (pe *PrometheusStatsEncoder) SetGauge(name string, labels map[string]string, value float64) {
+	labelNames, labelValues := sortedLabels(labels)
+	pe.mu.Lock()
+	defer pe.mu.Unlock()
+	gv, ok := pe.gaugeVecs[name]
+	if !ok {
+		gv = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: pe.Namespace + "_" + name,
+			Help: "FEVER gauge " + name,
+		}, labelNames)
+		pe.registry.MustRegister(gv)
+		pe.gaugeVecs[name] = gv
+	}
+	gv.WithLabelValues(labelValues...).Set(value)
+}
+
+// sortedLabels returns the keys of labels sorted alphabetically, along
+// with their corresponding values in the same order, so that repeated
+// calls for the same metric name always build the same label vector.
+func sortedLabels(labels map[string]string) (names []string, values []string) {
+	names = make([]string, 0, len(labels))
+	for k := range labels {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	values = make([]string, len(names))
+	for i, n := range names {
+		values[i] = labels[n]
+	}
+	return names, values
+}
+
+func toFloat64(v reflect.Value) float64 {
+	switch v.Kind() {
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(v.Uint())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int())
+	case reflect.Float32, reflect.Float64:
+		return v.Float()
+	default:
+		return 0
+	}
+}
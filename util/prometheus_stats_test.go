@@ -0,0 +1,45 @@
+package util
+
+// DCSO FEVER
+// Copyright (c) 2017, 2020, DCSO GmbH
+
+import "testing"
+
+type testPerfStats struct {
+	ForwardedPerSec uint64 `influx:"forwarded_events_per_sec"`
+}
+
+// TestMakePrometheusStatsEncoderOwnRegistry guards against two encoder
+// instances sharing the global default registry, which would make the
+// second Submit of a gauge with the same namespace panic with a
+// prometheus.AlreadyRegisteredError.
+func TestMakePrometheusStatsEncoderOwnRegistry(t *testing.T) {
+	a := MakePrometheusStatsEncoder("127.0.0.1:0", "fever", 0)
+	b := MakePrometheusStatsEncoder("127.0.0.1:0", "fever", 0)
+
+	a.Submit(testPerfStats{ForwardedPerSec: 1})
+	b.Submit(testPerfStats{ForwardedPerSec: 2})
+}
+
+func TestPrometheusStatsEncoderSubmitAndCounters(t *testing.T) {
+	pe := MakePrometheusStatsEncoder("127.0.0.1:0", "fever", 0)
+
+	pe.Submit(testPerfStats{ForwardedPerSec: 42})
+	pe.IncrCounter("events_total", map[string]string{"event_type": "alert"}, 1)
+	pe.SetGauge("filter_size", nil, 7)
+
+	metrics, err := pe.registry.Gather()
+	if err != nil {
+		t.Fatalf("Gather() error = %v", err)
+	}
+
+	names := make(map[string]bool)
+	for _, m := range metrics {
+		names[m.GetName()] = true
+	}
+	for _, want := range []string{"fever_forwarded_events_per_sec", "fever_events_total", "fever_filter_size"} {
+		if !names[want] {
+			t.Errorf("registry is missing metric %q, have %v", want, names)
+		}
+	}
+}
@@ -0,0 +1,29 @@
+package util
+
+// DCSO FEVER
+// Copyright (c) 2017, 2020, DCSO GmbH
+
+import "time"
+
+// StatsEncoder is implemented by components that accept periodic snapshots
+// of a handler's performance counters for external monitoring, regardless
+// of the concrete backend (InfluxDB, Prometheus, ...) they report to. This
+// allows handlers such as ForwardHandler and BloomHandler to submit their
+// stats without depending on a specific monitoring stack.
+type StatsEncoder interface {
+	// Submit encodes and ships a snapshot of performance counters. stats
+	// is expected to be a struct whose exported fields carry `influx`
+	// struct tags naming the corresponding metric.
+	Submit(stats interface{})
+	// GetSubmitPeriod returns how often a handler should call Submit.
+	GetSubmitPeriod() time.Duration
+	// IncrCounter increments a labeled counter metric by delta, creating
+	// it on first use. Encoders that have no notion of labels (e.g. the
+	// InfluxDB encoder, which relies on periodic Submit snapshots
+	// instead) may implement this as a no-op.
+	IncrCounter(name string, labels map[string]string, delta float64)
+	// SetGauge sets a labeled gauge metric to value, creating it on first
+	// use. Encoders with no notion of labels may implement this as a
+	// no-op.
+	SetGauge(name string, labels map[string]string, value float64)
+}